@@ -0,0 +1,318 @@
+package peco
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sentinel marks the end of a batch's worth of output from a
+// persistent external matcher coprocess.
+const sentinel = "\x00"
+
+// cancelDrainTimeout is how long acceptPersistent waits for a
+// coprocess to acknowledge a cancelled batch (by reaching the
+// sentinel) before giving up and killing it outright.
+const cancelDrainTimeout = 2 * time.Second
+
+// persistentCmd wraps a long-lived external matcher process so it can
+// be reused across many query batches instead of being forked anew
+// for each one.
+type persistentCmd struct {
+	mu     sync.Mutex
+	proto  string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	done   chan struct{} // closed once cmd.Wait returns
+}
+
+// persistentCmds caches the running coprocess for a given (cmd, args,
+// proto) tuple so it survives across the per-query *ExternalCmdFilter
+// clones that Filter.Work creates.
+var persistentCmds = struct {
+	mu sync.Mutex
+	m  map[string]*persistentCmd
+}{m: make(map[string]*persistentCmd)}
+
+func persistentCmdKey(proto, cmdName string, args []string) string {
+	return proto + "\x00" + cmdName + "\x00" + strings.Join(args, "\x00")
+}
+
+// acquirePersistentCmd returns the cached coprocess for this matcher,
+// starting it if this is the first time it's needed or if the
+// previous instance died.
+func acquirePersistentCmd(proto, cmdName string, args []string) (*persistentCmd, error) {
+	key := persistentCmdKey(proto, cmdName, args)
+
+	persistentCmds.mu.Lock()
+	pc, ok := persistentCmds.m[key]
+	persistentCmds.mu.Unlock()
+
+	if ok && pc.alive() {
+		return pc, nil
+	}
+
+	pc, err := startPersistentCmd(proto, cmdName, args)
+	if err != nil {
+		return nil, err
+	}
+
+	persistentCmds.mu.Lock()
+	persistentCmds.m[key] = pc
+	persistentCmds.mu.Unlock()
+	return pc, nil
+}
+
+func startPersistentCmd(proto, cmdName string, args []string) (*persistentCmd, error) {
+	cmd := exec.Command(cmdName, args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	pc := &persistentCmd{
+		proto:  proto,
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		close(pc.done)
+	}()
+
+	return pc, nil
+}
+
+// alive reports whether the coprocess is still running. cmd.Wait runs
+// in its own goroutine (see startPersistentCmd) and is what's allowed
+// to touch cmd.ProcessState, so alive checks pc.done instead of
+// reading that field directly, which would race with Wait's write.
+func (pc *persistentCmd) alive() bool {
+	select {
+	case <-pc.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (pc *persistentCmd) kill() {
+	if p := pc.cmd.Process; p != nil {
+		p.Kill()
+	}
+}
+
+// writeFrame writes s to w, framed according to proto: PersistentProtoLengthPrefixed
+// precedes the payload with its byte length so payloads may contain
+// embedded newlines; any other proto just newline-terminates it.
+func writeFrame(w io.Writer, proto string, s string) error {
+	if proto == PersistentProtoLengthPrefixed {
+		_, err := fmt.Fprintf(w, "%d\n%s", len(s), s)
+		return err
+	}
+	_, err := io.WriteString(w, s+"\n")
+	return err
+}
+
+// readFrame is the inverse of writeFrame.
+func readFrame(r *bufio.Reader, proto string) (string, error) {
+	if proto == PersistentProtoLengthPrefixed {
+		lengthLine, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		n, err := strconv.Atoi(strings.TrimRight(lengthLine, "\n"))
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\n"), nil
+}
+
+// acceptPersistent is the PersistentProto counterpart of Accept's
+// default fork-per-batch loop: it groups incoming lines into
+// thresholdBufsiz batches exactly as before, but sends each batch to a
+// single long-lived coprocess instead of exec'ing a fresh one.
+func (ecf *ExternalCmdFilter) acceptPersistent(cancelCh chan struct{}, incomingCh chan Line, outputCh chan Line) {
+	defer close(outputCh)
+	defer trace("ExternalCmdFilter.acceptPersistent: DONE")
+
+	buf := []Line{}
+	for l := range incomingCh {
+		buf = append(buf, l)
+		if len(buf) < ecf.thresholdBufsiz {
+			continue
+		}
+		ecf.runPersistentBatch(buf, cancelCh, outputCh)
+		buf = []Line{}
+	}
+
+	if len(buf) > 0 {
+		ecf.runPersistentBatch(buf, cancelCh, outputCh)
+	}
+}
+
+func (ecf *ExternalCmdFilter) runPersistentBatch(buf []Line, cancelCh chan struct{}, outputCh chan Line) {
+	defer func() { recover() }() // ignore errors, same as launchExternalCmd
+
+	trace("ExternalCmdFilter.runPersistentBatch: START")
+	defer trace("ExternalCmdFilter.runPersistentBatch: END")
+
+	// Unlike the fork-per-batch path, the query never goes on argv: it
+	// travels in the batch header (see sendBatch), so ecf.args is used
+	// as-is (any literal "$QUERY" placeholder is simply ignored here).
+	// Keying and starting the coprocess on this unsubstituted template
+	// is what lets it be reused across every keystroke instead of
+	// being respawned whenever the query changes.
+	pc, err := acquirePersistentCmd(ecf.persistentProto, ecf.cmd, ecf.args)
+	if err != nil {
+		return
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	// Write the request and read the response concurrently: a batch
+	// larger than the pipe buffer would otherwise deadlock against a
+	// coprocess that interleaves its own reads and writes.
+	sendDone := make(chan error, 1)
+	go func() {
+		sendDone <- pc.sendBatch(ecf.query, buf)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pc.readBatch(outputCh, cancelCh, ecf.enableSep)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-cancelCh:
+	}
+
+	// Wait for the request to finish going out (the concurrent
+	// reader above prevents this from deadlocking) before writing
+	// the control line, so it doesn't get interleaved into the
+	// middle of the batch we just sent.
+	select {
+	case <-sendDone:
+	case <-time.After(cancelDrainTimeout):
+		pc.kill()
+		return
+	}
+
+	// readBatch watches cancelCh too and may already have abandoned
+	// the batch (before reaching its sentinel) on its own, or may
+	// still be blocked reading a frame; either way, only one
+	// goroutine may read pc.stdout at a time, so wait for its
+	// goroutine to actually stop before draining stdout ourselves.
+	select {
+	case <-done:
+	case <-time.After(cancelDrainTimeout):
+		pc.kill()
+		return
+	}
+
+	// Tell the coprocess to abandon the in-flight batch, framed the
+	// same way as the rest of the stream. readBatch may have returned
+	// before reading this batch's sentinel (because the caller
+	// stopped draining outputCh), so the coprocess's reply to this
+	// batch can still be sitting unread on stdout; drain it now
+	// rather than leaving it for the next batch's readBatch to
+	// misinterpret as its own output.
+	writeFrame(pc.stdin, pc.proto, "C")
+
+	drainDone := make(chan struct{})
+	go func() {
+		defer close(drainDone)
+		pc.drainBatch()
+	}()
+	select {
+	case <-drainDone:
+	case <-time.After(cancelDrainTimeout):
+		pc.kill()
+	}
+}
+
+// sendBatch writes the "Q<len>\n<query>\n<n-lines>\n<line1>\n...\n<lineN>\n\x00\n"
+// request for a single batch. The header lines are always
+// newline-terminated; each line and the final sentinel are framed
+// with writeFrame according to pc.proto, so in
+// PersistentProtoLengthPrefixed mode they carry a length prefix
+// instead of the format shown above.
+func (pc *persistentCmd) sendBatch(query string, lines []Line) error {
+	if err := writeFrame(pc.stdin, "newline", fmt.Sprintf("Q%d", len(query))); err != nil {
+		return err
+	}
+	if err := writeFrame(pc.stdin, "newline", query); err != nil {
+		return err
+	}
+	if err := writeFrame(pc.stdin, "newline", strconv.Itoa(len(lines))); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if err := writeFrame(pc.stdin, pc.proto, l.DisplayString()); err != nil {
+			return err
+		}
+	}
+	return writeFrame(pc.stdin, pc.proto, sentinel)
+}
+
+// readBatch reads matched lines off the coprocess's stdout until the
+// sentinel line marks the end of the batch, or the read itself fails
+// (the coprocess died).
+func (pc *persistentCmd) readBatch(outputCh chan Line, cancelCh chan struct{}, enableSep bool) {
+	for {
+		line, err := readFrame(pc.stdout, pc.proto)
+		if err != nil || line == sentinel {
+			return
+		}
+
+		select {
+		case outputCh <- NewMatchedLine(NewRawLine(line, enableSep), nil):
+		case <-cancelCh:
+			return
+		}
+	}
+}
+
+// drainBatch discards frames from the coprocess until the sentinel
+// line is read, or a read error (the coprocess died). It's used to
+// resynchronize the stream after a cancelled batch whose output
+// readBatch abandoned before reaching the sentinel.
+func (pc *persistentCmd) drainBatch() {
+	for {
+		line, err := readFrame(pc.stdout, pc.proto)
+		if err != nil || line == sentinel {
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package peco
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestFrameRoundtripNewline(t *testing.T) {
+	var buf bytes.Buffer
+	for _, s := range []string{"hello world", "", sentinel} {
+		if err := writeFrame(&buf, PersistentProtoNewline, s); err != nil {
+			t.Fatalf("writeFrame failed: %s", err)
+		}
+	}
+
+	r := bufio.NewReader(&buf)
+	for _, want := range []string{"hello world", "", sentinel} {
+		got, err := readFrame(r, PersistentProtoNewline)
+		if err != nil {
+			t.Fatalf("readFrame failed: %s", err)
+		}
+		if got != want {
+			t.Errorf("readFrame = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestFrameRoundtripLengthPrefixed(t *testing.T) {
+	var buf bytes.Buffer
+	lines := []string{"line with\nembedded newline", "plain", sentinel}
+	for _, s := range lines {
+		if err := writeFrame(&buf, PersistentProtoLengthPrefixed, s); err != nil {
+			t.Fatalf("writeFrame failed: %s", err)
+		}
+	}
+
+	r := bufio.NewReader(&buf)
+	for _, want := range lines {
+		got, err := readFrame(r, PersistentProtoLengthPrefixed)
+		if err != nil {
+			t.Fatalf("readFrame failed: %s", err)
+		}
+		if got != want {
+			t.Errorf("readFrame = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPersistentCmdKeyDistinguishesArgs(t *testing.T) {
+	a := persistentCmdKey(PersistentProtoNewline, "fzf", []string{"--ignore-case"})
+	b := persistentCmdKey(PersistentProtoNewline, "fzf", []string{"--exact"})
+	if a == b {
+		t.Fatalf("expected different arg templates to produce different cache keys")
+	}
+}
+
+// The query travels only through the batch header (see sendBatch), so
+// the same unsubstituted args template must key (and start) the same
+// coprocess no matter what the current query is -- otherwise every
+// keystroke would spawn a brand new process and leak the old one.
+func TestPersistentCmdKeyIgnoresQuery(t *testing.T) {
+	args := []string{"--filter", "$QUERY"}
+	a := persistentCmdKey(PersistentProtoNewline, "fzf", args)
+	b := persistentCmdKey(PersistentProtoNewline, "fzf", args)
+	if a != b {
+		t.Fatalf("expected the same args template to always produce the same cache key")
+	}
+}
+
+func TestDrainBatchStopsAtSentinel(t *testing.T) {
+	var buf bytes.Buffer
+	for _, s := range []string{"leftover one", "leftover two", sentinel, "next batch's line"} {
+		if err := writeFrame(&buf, PersistentProtoNewline, s); err != nil {
+			t.Fatalf("writeFrame failed: %s", err)
+		}
+	}
+
+	pc := &persistentCmd{proto: PersistentProtoNewline, stdout: bufio.NewReader(&buf)}
+	pc.drainBatch()
+
+	got, err := readFrame(pc.stdout, PersistentProtoNewline)
+	if err != nil {
+		t.Fatalf("readFrame after drainBatch failed: %s", err)
+	}
+	if got != "next batch's line" {
+		t.Fatalf("drainBatch consumed into the next batch: got %q", got)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"sort"
 	"strings"
 	"unicode"
+
+	"github.com/dav009/peco/queryexpr"
 )
 
 // These are used as keys in the config file
@@ -20,6 +22,18 @@ const (
 	RegexpMatch        = "Regexp"
 )
 
+// These are the allowed values for the QuerySyntax config knob, which
+// selects how RegexpFilter parses incoming queries.
+const (
+	// QuerySyntaxBoolean parses queries as a boolean expression of
+	// AND (space or &&), OR (||), NOT (!) and parenthesis grouping.
+	QuerySyntaxBoolean = "boolean"
+	// QuerySyntaxLegacy reproduces peco's pre-boolean-grammar
+	// behavior: the query is simply split on whitespace and ANDed,
+	// except that a term with a leading "-" is negated.
+	QuerySyntaxLegacy = "legacy"
+)
+
 var ignoreCaseFlags = []string{"i"}
 var defaultFlags = []string{}
 
@@ -214,18 +228,43 @@ func (sf SelectionFilter) Name() string {
 
 type RegexpFilter struct {
 	simplePipeline
-	compiledQuery []*regexp.Regexp
-	flags         regexpFlags
-	quotemeta     bool
-	query         string
-	name          string
-	onEnd         func()
+	compiledExpr queryexpr.Node
+	flags        regexpFlags
+	quotemeta    bool
+	query        string
+	querySyntax  string
+	name         string
+	onEnd        func()
+	trigramIdx   *TrigramPrefilter
+	invert       bool
+	fieldSpec    *FieldSpec
+	tokenizer    *Tokenizer
 }
 
 func NewRegexpFilter() *RegexpFilter {
 	return &RegexpFilter{
 		flags: regexpFlagList(defaultFlags),
 		name:  "Regexp",
+		// QuerySyntaxBoolean is opt-in: defaulting to it would silently
+		// break existing users whose query happens to contain a
+		// boolean metacharacter (!, (, ), &&, ||) as literal regexp
+		// text, which previously matched as-is under the legacy
+		// space-separated-AND parsing.
+		querySyntax: QuerySyntaxLegacy,
+	}
+}
+
+// NewInvertFilter returns a filter (registerable via FilterSet.Add and
+// switchable through FilterSet.SetCurrentByName("Invert")) that keeps
+// a line only when none of its query terms match it, analogous to
+// `grep -v`.
+func NewInvertFilter() *RegexpFilter {
+	return &RegexpFilter{
+		flags:       regexpFlagList(defaultFlags),
+		quotemeta:   true,
+		name:        "Invert",
+		querySyntax: QuerySyntaxBoolean,
+		invert:      true,
 	}
 }
 
@@ -236,45 +275,116 @@ func (rf RegexpFilter) Clone() QueryFilterer {
 		rf.flags,
 		rf.quotemeta,
 		rf.query,
+		rf.querySyntax,
 		rf.name,
 		nil,
+		nil,
+		rf.invert,
+		rf.fieldSpec,
+		rf.tokenizer,
 	}
 }
 
+// SetFieldSpec restricts subsequent filter() calls to matching query
+// terms only within the fields fs selects out of each line, as split
+// by the filter's Tokenizer (see SetTokenizer). Corresponds to the
+// Nth config key.
+func (rf *RegexpFilter) SetFieldSpec(fs FieldSpec) {
+	rf.fieldSpec = &fs
+}
+
+// SetTokenizer sets the Tokenizer used to split lines into fields for
+// SetFieldSpec. Corresponds to the Delimiter config key.
+func (rf *RegexpFilter) SetTokenizer(t *Tokenizer) {
+	rf.tokenizer = t
+}
+
+// SetQuerySyntax selects how SetQuery parses subsequent queries. See
+// QuerySyntaxBoolean and QuerySyntaxLegacy.
+func (rf *RegexpFilter) SetQuerySyntax(s string) {
+	rf.querySyntax = s
+}
+
 func (rf *RegexpFilter) Accept(p Pipeliner) {
 	cancelCh, incomingCh := p.Pipeline()
 	rf.cancelCh = cancelCh
 	rf.outputCh = make(chan Line)
-	go acceptPipeline(cancelCh, incomingCh, rf.outputCh,
+
+	feedCh := incomingCh
+	if src, ok := p.(trigramSource); ok && !rf.invert && src.Size() > TrigramThreshold {
+		rf.trigramIdx = trigramCache.get(src)
+		if ids, candOk := rf.candidateLineIDs(); candOk {
+			feedCh = filterByLineID(cancelCh, incomingCh, ids)
+		}
+	}
+
+	go acceptPipeline(cancelCh, feedCh, rf.outputCh,
 		&pipelineCtx{rf.filter, rf.onEnd})
 }
 
+// candidateLineIDs asks the trigram prefilter which lines could
+// possibly match the current query. ok is false when the query is
+// empty, fails to compile, or derives to "any" (e.g. it's just a
+// character class or a `.*`), in which case callers must fall back to
+// a full scan.
+func (rf *RegexpFilter) candidateLineIDs() (ids []int, ok bool) {
+	if rf.trigramIdx == nil {
+		return nil, false
+	}
+
+	expr, err := rf.getQueryAsExpr()
+	if err != nil {
+		return nil, false
+	}
+
+	return trigramExprForNode(expr).candidates(rf.trigramIdx)
+}
+
 var ErrFilterDidNotMatch = errors.New("error: filter did not match against given line")
 
 func (rf *RegexpFilter) filter(l Line) (Line, error) {
 	trace("RegexpFilter.filter: START")
 	defer trace("RegexpFilter.filter: END")
-	regexps, err := rf.getQueryAsRegexps()
+	expr, err := rf.getQueryAsExpr()
 	if err != nil {
 		return nil, err
 	}
 	v := l.DisplayString()
-	allMatched := true
-	matches := [][]int{}
-TryRegexps:
-	for _, rx := range regexps {
-		trace("RegexpFilter.filter: matching '%s' against '%s'", v, rx)
-		match := rx.FindAllStringSubmatchIndex(v, -1)
-		if match == nil {
-			allMatched = false
-			break TryRegexps
+
+	matchTarget := v
+	var view *selectedView
+	if rf.fieldSpec != nil && rf.tokenizer != nil {
+		tokens := rf.tokenizer.Tokenize(v)
+		view = buildSelectedView(tokens, rf.fieldSpec.Resolve(len(tokens)))
+		matchTarget = view.text
+	}
+
+	trace("RegexpFilter.filter: matching '%s' against '%s'", matchTarget, expr)
+	var ok bool
+	var matches [][]int
+	if rf.invert {
+		// An inverted filter keeps the line only when none of the
+		// query's individual terms match it (grep -v semantics); it
+		// has nothing sensible to highlight in that case. Negating
+		// the whole expression's result would be wrong here, since
+		// e.g. "foo bar" parses to And(foo, bar) and !(foo && bar)
+		// keeps a line missing just one of the two terms.
+		ok, matches = true, nil
+		for _, term := range collectQueryTerms(expr) {
+			if termOk, _ := term.Match(matchTarget); termOk {
+				ok = false
+				break
+			}
 		}
-		matches = append(matches, match...)
+	} else {
+		ok, matches = expr.Match(matchTarget)
 	}
-
-	if !allMatched {
+	if !ok {
 		return nil, ErrFilterDidNotMatch
 	}
+	if view != nil {
+		matches = view.translateSpans(matches)
+	}
 
 	trace("RegexpFilter.filter: line matched pattern\n")
 	sort.Sort(byMatchStart(matches))
@@ -308,22 +418,54 @@ TryRegexps:
 	return NewMatchedLine(l, deduped), nil
 }
 
-func (rf *RegexpFilter) getQueryAsRegexps() ([]*regexp.Regexp, error) {
-	if q := rf.compiledQuery; q != nil {
-		return q, nil
+// collectQueryTerms flattens expr down to its Term leaves, in order,
+// regardless of how they were combined with And/Or/Not. It's used to
+// implement invert-filter semantics, which test each term
+// individually rather than the combined expression.
+func collectQueryTerms(expr queryexpr.Node) []*queryexpr.Term {
+	var terms []*queryexpr.Term
+	switch n := expr.(type) {
+	case *queryexpr.And:
+		terms = append(terms, collectQueryTerms(n.Left)...)
+		terms = append(terms, collectQueryTerms(n.Right)...)
+	case *queryexpr.Or:
+		terms = append(terms, collectQueryTerms(n.Left)...)
+		terms = append(terms, collectQueryTerms(n.Right)...)
+	case *queryexpr.Not:
+		terms = append(terms, collectQueryTerms(n.Child)...)
+	case *queryexpr.Term:
+		terms = append(terms, n)
+	}
+	return terms
+}
+
+func (rf *RegexpFilter) getQueryAsExpr() (queryexpr.Node, error) {
+	if e := rf.compiledExpr; e != nil {
+		return e, nil
+	}
+
+	compile := func(term string) (*regexp.Regexp, error) {
+		return regexpFor(term, rf.flags.flags(rf.query), rf.quotemeta)
+	}
+
+	var e queryexpr.Node
+	var err error
+	if rf.querySyntax == QuerySyntaxBoolean {
+		e, err = queryexpr.Parse(rf.query, compile)
+	} else {
+		e, err = queryexpr.ParseLegacy(rf.query, compile)
 	}
-	q, err := queryToRegexps(rf.flags, rf.quotemeta, rf.query)
 	if err != nil {
 		return nil, err
 	}
 
-	rf.compiledQuery = q
-	return q, nil
+	rf.compiledExpr = e
+	return e, nil
 }
 
 func (rf *RegexpFilter) SetQuery(q string) {
 	rf.query = q
-	rf.compiledQuery = nil
+	rf.compiledExpr = nil
 }
 
 func (rf RegexpFilter) String() string {
@@ -372,6 +514,25 @@ func (fs *FilterSet) GetCurrent() QueryFilterer {
 	return fs.filters[fs.current]
 }
 
+// ApplyFilterConfig applies fc's Nth/Delimiter config keys to the
+// filter registered under name, letting different presets in fs carry
+// their own column restriction (e.g. "Regexp" and "Invert" each with
+// a different Nth). It's a no-op, not an error, if that filter isn't
+// a *RegexpFilter, since only RegexpFilter supports field specs.
+func (fs *FilterSet) ApplyFilterConfig(name string, fc FilterConfig) error {
+	for _, f := range fs.filters {
+		if f.String() != name {
+			continue
+		}
+		rf, ok := f.(*RegexpFilter)
+		if !ok {
+			return nil
+		}
+		return ApplyFieldSpec(rf, fc)
+	}
+	return ErrFilterNotFound
+}
+
 func NewIgnoreCaseFilter() *RegexpFilter {
 	return &RegexpFilter{
 		flags:     regexpFlagList(ignoreCaseFlags),
@@ -403,6 +564,25 @@ func NewSmartCaseFilter() *RegexpFilter {
 	}
 }
 
+// These are the allowed values for an ExternalCmdFilter's
+// PersistentProto, selecting whether (and how) the external matcher is
+// kept running as a long-lived coprocess instead of being
+// exec'd per query batch.
+const (
+	// PersistentProtoNone forks the external command anew for every
+	// thresholdBufsiz batch, exactly as peco has always done.
+	PersistentProtoNone = "none"
+	// PersistentProtoNewline runs the external command once and
+	// frames each line of the request/response protocol with a
+	// trailing newline.
+	PersistentProtoNewline = "newline"
+	// PersistentProtoLengthPrefixed is like PersistentProtoNewline,
+	// but frames each line's payload with an explicit byte length
+	// instead of relying on embedded newlines, so matchers can safely
+	// emit lines containing newline characters.
+	PersistentProtoLengthPrefixed = "length-prefixed"
+)
+
 type ExternalCmdFilter struct {
 	simplePipeline
 	enableSep       bool
@@ -411,6 +591,7 @@ type ExternalCmdFilter struct {
 	name            string
 	query           string
 	thresholdBufsiz int
+	persistentProto string
 }
 
 func NewExternalCmdFilter(name, cmd string, args []string, threshold int, enableSep bool) *ExternalCmdFilter {
@@ -426,9 +607,18 @@ func NewExternalCmdFilter(name, cmd string, args []string, threshold int, enable
 		args:            args,
 		name:            name,
 		thresholdBufsiz: threshold,
+		persistentProto: PersistentProtoNone,
 	}
 }
 
+// SetPersistentProto selects whether Accept runs the external matcher
+// as a single long-lived coprocess (PersistentProtoNewline or
+// PersistentProtoLengthPrefixed) instead of forking it per batch
+// (PersistentProtoNone, the default).
+func (ecf *ExternalCmdFilter) SetPersistentProto(proto string) {
+	ecf.persistentProto = proto
+}
+
 func (ecf ExternalCmdFilter) Clone() QueryFilterer {
 	return &ExternalCmdFilter{
 		simplePipeline:  simplePipeline{},
@@ -437,6 +627,7 @@ func (ecf ExternalCmdFilter) Clone() QueryFilterer {
 		args:            ecf.args,
 		name:            ecf.name,
 		thresholdBufsiz: ecf.thresholdBufsiz,
+		persistentProto: ecf.persistentProto,
 	}
 }
 
@@ -457,6 +648,11 @@ func (ecf *ExternalCmdFilter) Accept(p Pipeliner) {
 	ecf.cancelCh = cancelCh
 	ecf.outputCh = outputCh
 
+	if ecf.persistentProto != PersistentProtoNone {
+		go ecf.acceptPersistent(cancelCh, incomingCh, outputCh)
+		return
+	}
+
 	go func() {
 		defer close(outputCh)
 
@@ -0,0 +1,37 @@
+package peco
+
+import "testing"
+
+func TestInvertFilterRequiresAllTermsToMiss(t *testing.T) {
+	rf := NewInvertFilter()
+	rf.SetQuery("foo bar")
+
+	if _, err := rf.filter(NewRawLine("foo only", false)); err != ErrFilterDidNotMatch {
+		t.Fatalf("expected a line matching one of two terms to be rejected, got err=%v", err)
+	}
+	if _, err := rf.filter(NewRawLine("neither", false)); err != nil {
+		t.Fatalf("expected a line matching no terms to pass, got err=%v", err)
+	}
+}
+
+func TestFilterSetApplyFilterConfig(t *testing.T) {
+	fs := &FilterSet{}
+	rf := NewRegexpFilter()
+	if err := fs.Add(rf); err != nil {
+		t.Fatalf("Add failed: %s", err)
+	}
+
+	if err := fs.ApplyFilterConfig("Regexp", FilterConfig{Nth: "2", Delimiter: ","}); err != nil {
+		t.Fatalf("ApplyFilterConfig failed: %s", err)
+	}
+	if rf.fieldSpec == nil || rf.tokenizer == nil {
+		t.Fatalf("expected ApplyFilterConfig to set fieldSpec and tokenizer on the named filter")
+	}
+}
+
+func TestFilterSetApplyFilterConfigUnknownName(t *testing.T) {
+	fs := &FilterSet{}
+	if err := fs.ApplyFilterConfig("NoSuchFilter", FilterConfig{Nth: "2"}); err != ErrFilterNotFound {
+		t.Fatalf("expected ErrFilterNotFound, got %v", err)
+	}
+}
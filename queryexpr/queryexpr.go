@@ -0,0 +1,331 @@
+// Package queryexpr implements the boolean query grammar used by
+// peco's RegexpFilter: terms combined with AND (space or &&), OR
+// (||), NOT (!) and parenthesis grouping.
+package queryexpr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Node is a single node in a parsed query expression. Match reports
+// whether s satisfies the node and, if so, the match spans
+// contributed by the Term leaves that participated in that result;
+// these are the spans the caller should highlight.
+type Node interface {
+	Match(s string) (bool, [][]int)
+	Clone() Node
+	String() string
+}
+
+// And requires both Left and Right to match.
+type And struct {
+	Left, Right Node
+}
+
+func (n *And) Match(s string) (bool, [][]int) {
+	lok, lspans := n.Left.Match(s)
+	if !lok {
+		return false, nil
+	}
+	rok, rspans := n.Right.Match(s)
+	if !rok {
+		return false, nil
+	}
+	return true, append(lspans, rspans...)
+}
+
+func (n *And) Clone() Node {
+	return &And{Left: n.Left.Clone(), Right: n.Right.Clone()}
+}
+
+func (n *And) String() string {
+	return fmt.Sprintf("(%s && %s)", n.Left, n.Right)
+}
+
+// Or requires either Left or Right to match; if both would match, the
+// spans of whichever branch was tried first (Left) are used.
+type Or struct {
+	Left, Right Node
+}
+
+func (n *Or) Match(s string) (bool, [][]int) {
+	if ok, spans := n.Left.Match(s); ok {
+		return true, spans
+	}
+	return n.Right.Match(s)
+}
+
+func (n *Or) Clone() Node {
+	return &Or{Left: n.Left.Clone(), Right: n.Right.Clone()}
+}
+
+func (n *Or) String() string {
+	return fmt.Sprintf("(%s || %s)", n.Left, n.Right)
+}
+
+// Not requires Child to not match. A Not contributes no match spans
+// of its own, since there's nothing meaningful to highlight about the
+// absence of a match.
+type Not struct {
+	Child Node
+}
+
+func (n *Not) Match(s string) (bool, [][]int) {
+	ok, _ := n.Child.Match(s)
+	return !ok, nil
+}
+
+func (n *Not) Clone() Node {
+	return &Not{Child: n.Child.Clone()}
+}
+
+func (n *Not) String() string {
+	return fmt.Sprintf("!%s", n.Child)
+}
+
+// Term is a leaf node wrapping a single compiled regexp.
+type Term struct {
+	Re   *regexp.Regexp
+	Text string
+}
+
+func (n *Term) Match(s string) (bool, [][]int) {
+	m := n.Re.FindAllStringSubmatchIndex(s, -1)
+	if m == nil {
+		return false, nil
+	}
+	return true, m
+}
+
+func (n *Term) Clone() Node {
+	return &Term{Re: n.Re, Text: n.Text}
+}
+
+func (n *Term) String() string {
+	return n.Text
+}
+
+// CompileFunc compiles a single bare term (as produced by the
+// tokenizer) into a regexp, applying whatever flags and quoting the
+// caller's filter is configured with.
+type CompileFunc func(term string) (*regexp.Regexp, error)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+	tokTerm
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(q string) []token {
+	var toks []token
+	n := len(q)
+	for i := 0; i < n; {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "("})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")"})
+			i++
+		case c == '!':
+			toks = append(toks, token{tokNot, "!"})
+			i++
+		case c == '&' && i+1 < n && q[i+1] == '&':
+			toks = append(toks, token{tokAnd, "&&"})
+			i += 2
+		case c == '|' && i+1 < n && q[i+1] == '|':
+			toks = append(toks, token{tokOr, "||"})
+			i += 2
+		default:
+			j := i
+			for j < n && !isSpecial(q, j) {
+				j++
+			}
+			toks = append(toks, token{tokTerm, q[i:j]})
+			i = j
+		}
+	}
+	return append(toks, token{tokEOF, ""})
+}
+
+func isSpecial(q string, i int) bool {
+	switch q[i] {
+	case ' ', '\t', '(', ')', '!':
+		return true
+	case '&':
+		return i+1 < len(q) && q[i+1] == '&'
+	case '|':
+		return i+1 < len(q) && q[i+1] == '|'
+	}
+	return false
+}
+
+type parser struct {
+	toks    []token
+	pos     int
+	compile CompileFunc
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if p.pos < len(p.toks)-1 {
+		p.pos++
+	}
+	return t
+}
+
+// startsUnary reports whether t could begin another operand of an
+// implicit AND, i.e. there was no explicit operator but two terms
+// appeared back to back ("foo bar").
+func startsUnary(t token) bool {
+	switch t.kind {
+	case tokTerm, tokNot, tokLParen:
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr() (Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd || startsUnary(p.peek()) {
+		if p.peek().kind == tokAnd {
+			p.next()
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	switch p.peek().kind {
+	case tokNot:
+		p.next()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Child: child}, nil
+	case tokLParen:
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, fmt.Errorf("queryexpr: expected ')', got %q", p.peek().text)
+		}
+		p.next()
+		return inner, nil
+	case tokTerm:
+		t := p.next()
+		return termNode(t.text, p.compile)
+	default:
+		return nil, fmt.Errorf("queryexpr: unexpected token %q", p.peek().text)
+	}
+}
+
+// termNode compiles a single bare term into a Node. A leading "-"
+// (e.g. "-debug", "-/^\\s*#/") negates the term, mirroring grep -v and
+// the ignore-list convention used by log-watching tools: the rest of
+// the token is compiled normally and wrapped in Not.
+func termNode(text string, compile CompileFunc) (Node, error) {
+	if len(text) > 1 && text[0] == '-' {
+		inner, err := termNode(text[1:], compile)
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Child: inner}, nil
+	}
+
+	re, err := compile(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Term{Re: re, Text: text}, nil
+}
+
+// Parse parses query using the boolean grammar (AND/OR/NOT/grouping)
+// and compiles each bare term via compile.
+func Parse(query string, compile CompileFunc) (Node, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("queryexpr: empty query")
+	}
+
+	p := &parser{toks: tokenize(query), compile: compile}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("queryexpr: unexpected trailing token %q", p.peek().text)
+	}
+	return n, nil
+}
+
+// ParseLegacy reproduces peco's pre-boolean-grammar behavior: query is
+// split on whitespace and each resulting token is compiled verbatim as
+// a Term (other than a leading "-", which still negates the term), with
+// no further operator parsing at all, ANDed together. It exists so
+// that QuerySyntax: "legacy" keeps working for queries that happen to
+// contain characters the boolean grammar treats specially.
+func ParseLegacy(query string, compile CompileFunc) (Node, error) {
+	terms := strings.Split(strings.TrimSpace(query), " ")
+
+	var n Node
+	for _, t := range terms {
+		term, err := termNode(t, compile)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			n = term
+			continue
+		}
+		n = &And{Left: n, Right: term}
+	}
+	return n, nil
+}
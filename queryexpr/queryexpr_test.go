@@ -0,0 +1,163 @@
+package queryexpr
+
+import (
+	"regexp"
+	"testing"
+)
+
+func compile(term string) (*regexp.Regexp, error) {
+	return regexp.Compile(regexp.QuoteMeta(term))
+}
+
+func mustParse(t *testing.T, query string) Node {
+	t.Helper()
+	n, err := Parse(query, compile)
+	if err != nil {
+		t.Fatalf("Parse(%q) failed: %s", query, err)
+	}
+	return n
+}
+
+func TestImplicitAndMatchesLegacySpaceSeparated(t *testing.T) {
+	a := mustParse(t, "foo bar")
+	b := mustParse(t, "foo && bar")
+
+	lines := []string{"foo bar baz", "foo only", "bar only", "neither"}
+	for _, l := range lines {
+		aOk, _ := a.Match(l)
+		bOk, _ := b.Match(l)
+		if aOk != bOk {
+			t.Errorf("line %q: implicit AND = %v, explicit && = %v", l, aOk, bOk)
+		}
+	}
+}
+
+func TestOr(t *testing.T) {
+	n := mustParse(t, "foo || bar")
+	cases := map[string]bool{
+		"foo":     true,
+		"bar":     true,
+		"foo bar": true,
+		"baz":     false,
+	}
+	for l, want := range cases {
+		ok, _ := n.Match(l)
+		if ok != want {
+			t.Errorf("Match(%q) = %v, want %v", l, ok, want)
+		}
+	}
+}
+
+func TestNot(t *testing.T) {
+	n := mustParse(t, "!foo")
+	cases := map[string]bool{
+		"foo":     false,
+		"foo bar": false,
+		"bar":     true,
+		"":        true,
+	}
+	for l, want := range cases {
+		ok, _ := n.Match(l)
+		if ok != want {
+			t.Errorf("Match(%q) = %v, want %v", l, ok, want)
+		}
+	}
+}
+
+func TestGrouping(t *testing.T) {
+	n := mustParse(t, "(foo || bar) && !baz")
+	cases := map[string]bool{
+		"foo":     true,
+		"bar":     true,
+		"foo baz": false,
+		"bar baz": false,
+		"qux":     false,
+	}
+	for l, want := range cases {
+		ok, _ := n.Match(l)
+		if ok != want {
+			t.Errorf("Match(%q) = %v, want %v", l, ok, want)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	n := mustParse(t, "(foo || bar) && !baz")
+	c := n.Clone()
+	if c.String() != n.String() {
+		t.Fatalf("clone diverged: %s != %s", c, n)
+	}
+}
+
+func TestLeadingDashNegatesTerm(t *testing.T) {
+	n := mustParse(t, "error -debug")
+	cases := map[string]bool{
+		"error":             true,
+		"error: debug mode": false,
+		"debug":             false,
+		"info":              false,
+	}
+	for l, want := range cases {
+		ok, spans := n.Match(l)
+		if ok != want {
+			t.Errorf("Match(%q) = %v, want %v", l, ok, want)
+		}
+		if !ok && len(spans) != 0 {
+			t.Errorf("Match(%q): expected no spans on non-match, got %v", l, spans)
+		}
+	}
+
+	// The negated term shouldn't contribute highlight spans even when
+	// the overall expression matches.
+	ok, spans := n.Match("error")
+	if !ok {
+		t.Fatalf("expected %q to match", "error")
+	}
+	if len(spans) != 1 {
+		t.Fatalf("expected exactly the positive term's span, got %v", spans)
+	}
+}
+
+// smartCaseCompile mimics RegexpFilter's SmartCase flag: case
+// sensitive if the query contains an upper-case letter, otherwise
+// case-insensitive.
+func smartCaseCompile(term string) (*regexp.Regexp, error) {
+	flags := "(?i)"
+	for _, c := range term {
+		if c >= 'A' && c <= 'Z' {
+			flags = ""
+			break
+		}
+	}
+	return regexp.Compile(flags + regexp.QuoteMeta(term))
+}
+
+func TestNegationWithSmartCase(t *testing.T) {
+	n, err := Parse("-Debug", smartCaseCompile)
+	if err != nil {
+		t.Fatalf("Parse failed: %s", err)
+	}
+
+	// "Debug" contains an upper-case letter, so SmartCase makes the
+	// match case-sensitive; negation should still only rule out exact
+	// case matches.
+	if ok, _ := n.Match("debug mode"); !ok {
+		t.Errorf("expected lower-case 'debug' to survive negation of case-sensitive 'Debug'")
+	}
+	if ok, _ := n.Match("Debug mode"); ok {
+		t.Errorf("expected 'Debug mode' to be excluded by -Debug")
+	}
+}
+
+func TestParseLegacyIgnoresOperators(t *testing.T) {
+	n, err := ParseLegacy("foo (bar|baz)", compile)
+	if err != nil {
+		t.Fatalf("ParseLegacy failed: %s", err)
+	}
+	// Legacy parsing treats "(bar|baz)" as a single literal regexp
+	// term, not as a grouped OR expression.
+	ok, _ := n.Match("foo (bar|baz)")
+	if !ok {
+		t.Fatalf("expected legacy parse to match the literal term verbatim")
+	}
+}
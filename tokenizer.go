@@ -0,0 +1,243 @@
+package peco
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Token is a single field produced by splitting a line with a
+// Tokenizer, along with its byte offset within the original line.
+type Token struct {
+	Text   string
+	Offset int
+}
+
+// Tokenizer splits a line into fields on a delimiter regex, the same
+// approach fzf-style tools use for their --nth/--delimiter options.
+type Tokenizer struct {
+	delimiter *regexp.Regexp
+}
+
+// NewTokenizer creates a Tokenizer that splits on delim, a regular
+// expression (e.g. `\s+`, `:`, `,`). An empty delim defaults to runs
+// of whitespace (`\s+`). Unlike awk's default field splitting, leading
+// whitespace is not skipped: it produces an empty first field.
+func NewTokenizer(delim string) (*Tokenizer, error) {
+	if delim == "" {
+		delim = `\s+`
+	}
+	re, err := regexp.Compile(delim)
+	if err != nil {
+		return nil, err
+	}
+	return &Tokenizer{delimiter: re}, nil
+}
+
+// Tokenize splits s into fields on t's delimiter, each carrying its
+// byte offset within s so matches against it can be translated back
+// to full-line coordinates.
+func (t *Tokenizer) Tokenize(s string) []Token {
+	matches := t.delimiter.FindAllStringIndex(s, -1)
+	tokens := make([]Token, 0, len(matches)+1)
+
+	pos := 0
+	for _, m := range matches {
+		tokens = append(tokens, Token{Text: s[pos:m[0]], Offset: pos})
+		pos = m[1]
+	}
+	tokens = append(tokens, Token{Text: s[pos:], Offset: pos})
+	return tokens
+}
+
+// fieldRange is a single comma-separated piece of a FieldSpec, e.g.
+// the "4-6" in "2,4-6". start/end are 1-based and may be negative to
+// count from the last field, following the "2..-1" style also
+// accepted for start/end.
+type fieldRange struct {
+	start   int
+	end     int
+	endOpen bool // true for "N..", meaning "through the last field"
+}
+
+// FieldSpec selects one or more 1-based field ranges out of a
+// Tokenizer's output, e.g. "2", "3..", "..-1" or "2,4-6".
+type FieldSpec struct {
+	ranges []fieldRange
+}
+
+// ParseFieldSpec parses the Nth config syntax into a FieldSpec.
+func ParseFieldSpec(spec string) (FieldSpec, error) {
+	var fs FieldSpec
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseFieldRange(part)
+		if err != nil {
+			return FieldSpec{}, err
+		}
+		fs.ranges = append(fs.ranges, r)
+	}
+	if len(fs.ranges) == 0 {
+		return FieldSpec{}, fmt.Errorf("tokenizer: empty field spec %q", spec)
+	}
+	return fs, nil
+}
+
+func parseFieldRange(s string) (fieldRange, error) {
+	if i := strings.Index(s, ".."); i >= 0 {
+		start := 1
+		if startStr := s[:i]; startStr != "" {
+			n, err := strconv.Atoi(startStr)
+			if err != nil {
+				return fieldRange{}, fmt.Errorf("tokenizer: invalid field spec %q: %s", s, err)
+			}
+			start = n
+		}
+
+		endStr := s[i+2:]
+		if endStr == "" {
+			return fieldRange{start: start, endOpen: true}, nil
+		}
+		end, err := strconv.Atoi(endStr)
+		if err != nil {
+			return fieldRange{}, fmt.Errorf("tokenizer: invalid field spec %q: %s", s, err)
+		}
+		return fieldRange{start: start, end: end}, nil
+	}
+
+	// Look for a range-separating '-' after the first character, so a
+	// leading '-' (a negative field number) isn't mistaken for one.
+	if i := strings.Index(s[1:], "-"); i >= 0 {
+		sep := i + 1
+		start, err := strconv.Atoi(s[:sep])
+		if err != nil {
+			return fieldRange{}, fmt.Errorf("tokenizer: invalid field spec %q: %s", s, err)
+		}
+		end, err := strconv.Atoi(s[sep+1:])
+		if err != nil {
+			return fieldRange{}, fmt.Errorf("tokenizer: invalid field spec %q: %s", s, err)
+		}
+		return fieldRange{start: start, end: end}, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fieldRange{}, fmt.Errorf("tokenizer: invalid field spec %q: %s", s, err)
+	}
+	return fieldRange{start: n, end: n}, nil
+}
+
+// resolveFieldIndex turns a possibly-negative 1-based field number
+// into an absolute 1-based index given the total number of fields
+// available; -1 is the last field, -2 the second-to-last, and so on.
+func resolveFieldIndex(n, total int) int {
+	if n < 0 {
+		return total + n + 1
+	}
+	return n
+}
+
+// Resolve expands fs into the sorted, deduped list of 1-based field
+// indices it selects out of a line with total fields, clipped to
+// [1, total].
+func (fs FieldSpec) Resolve(total int) []int {
+	seen := make(map[int]struct{})
+	var out []int
+	for _, r := range fs.ranges {
+		start := resolveFieldIndex(r.start, total)
+		end := total
+		if !r.endOpen {
+			end = resolveFieldIndex(r.end, total)
+		}
+		if start < 1 {
+			start = 1
+		}
+		if end > total {
+			end = total
+		}
+		for i := start; i <= end; i++ {
+			if _, ok := seen[i]; ok {
+				continue
+			}
+			seen[i] = struct{}{}
+			out = append(out, i)
+		}
+	}
+	sort.Ints(out)
+	return out
+}
+
+// selectedView is the string formed by concatenating, in order, the
+// tokens a FieldSpec selects, along with enough bookkeeping to
+// translate match offsets within it back to offsets in the original
+// line.
+type selectedView struct {
+	text       string
+	segStarts  []int // offset within text where each selected token begins
+	segOrigins []int // the same token's offset within the original line
+}
+
+// fieldSeparator joins consecutive selected tokens in a selectedView's
+// text, whether or not they are adjacent in the line (e.g. Nth "2,4"
+// skips field 3, and Nth "2,3" still gets a separator in place of the
+// original delimiter). Go's regexp "." never matches "\n" unless the
+// "s" flag is set, and RegexpFilter never sets it, so "." cannot match
+// across a separator; patterns that do match "\n", such as `\s` or a
+// negated character class, still can.
+const fieldSeparator = "\n"
+
+func buildSelectedView(tokens []Token, indices []int) *selectedView {
+	sv := &selectedView{
+		segStarts:  make([]int, 0, len(indices)),
+		segOrigins: make([]int, 0, len(indices)),
+	}
+
+	var b strings.Builder
+	for i, idx := range indices {
+		if i > 0 {
+			b.WriteString(fieldSeparator)
+		}
+		tok := tokens[idx-1]
+		sv.segStarts = append(sv.segStarts, b.Len())
+		sv.segOrigins = append(sv.segOrigins, tok.Offset)
+		b.WriteString(tok.Text)
+	}
+	sv.text = b.String()
+	return sv
+}
+
+// translate maps a byte offset within sv.text back to its offset in
+// the original line.
+func (sv *selectedView) translate(off int) int {
+	seg := 0
+	for i, start := range sv.segStarts {
+		if start <= off {
+			seg = i
+		}
+	}
+	return sv.segOrigins[seg] + (off - sv.segStarts[seg])
+}
+
+// translateSpans maps a set of FindAllStringSubmatchIndex-style spans
+// (as returned by matching against sv.text) back to spans in the
+// original line.
+func (sv *selectedView) translateSpans(spans [][]int) [][]int {
+	out := make([][]int, len(spans))
+	for i, m := range spans {
+		tm := make([]int, len(m))
+		for j, v := range m {
+			if v < 0 {
+				tm[j] = v
+				continue
+			}
+			tm[j] = sv.translate(v)
+		}
+		out[i] = tm
+	}
+	return out
+}
@@ -0,0 +1,37 @@
+package peco
+
+// FilterConfig holds the subset of a RegexpFilter's config-file
+// settings that restrict matching to specific columns. It mirrors
+// fzf-style --nth/--delimiter options: Nth selects the fields to
+// match against (see ParseFieldSpec for its syntax) and Delimiter is
+// the regexp those fields are split on (see NewTokenizer). It's meant
+// to be unmarshaled straight from the peco config file's per-filter
+// section, e.g. "Filters": {"Regexp": {"Nth": "2", "Delimiter": ","}},
+// and applied via FilterSet.ApplyFilterConfig.
+type FilterConfig struct {
+	Nth       string `json:"Nth"`
+	Delimiter string `json:"Delimiter"`
+}
+
+// ApplyFieldSpec wires fc's Nth/Delimiter config keys into rf, calling
+// SetFieldSpec and SetTokenizer so that subsequent filter() calls
+// restrict matching to the selected columns. It's a no-op when Nth is
+// empty, since a FieldSpec is meaningless without one.
+func ApplyFieldSpec(rf *RegexpFilter, fc FilterConfig) error {
+	if fc.Nth == "" {
+		return nil
+	}
+
+	fs, err := ParseFieldSpec(fc.Nth)
+	if err != nil {
+		return err
+	}
+	tok, err := NewTokenizer(fc.Delimiter)
+	if err != nil {
+		return err
+	}
+
+	rf.SetFieldSpec(fs)
+	rf.SetTokenizer(tok)
+	return nil
+}
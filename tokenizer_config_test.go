@@ -0,0 +1,40 @@
+package peco
+
+import "testing"
+
+func TestApplyFieldSpecNoOpWhenNthEmpty(t *testing.T) {
+	rf := NewRegexpFilter()
+	if err := ApplyFieldSpec(rf, FilterConfig{}); err != nil {
+		t.Fatalf("ApplyFieldSpec failed: %s", err)
+	}
+	if rf.fieldSpec != nil || rf.tokenizer != nil {
+		t.Fatalf("expected no field spec or tokenizer to be set for an empty Nth")
+	}
+}
+
+func TestApplyFieldSpecSetsFieldSpecAndTokenizer(t *testing.T) {
+	rf := NewRegexpFilter()
+	if err := ApplyFieldSpec(rf, FilterConfig{Nth: "2", Delimiter: ","}); err != nil {
+		t.Fatalf("ApplyFieldSpec failed: %s", err)
+	}
+	if rf.fieldSpec == nil {
+		t.Fatalf("expected fieldSpec to be set")
+	}
+	if rf.tokenizer == nil {
+		t.Fatalf("expected tokenizer to be set")
+	}
+
+	tokens := rf.tokenizer.Tokenize("a,b,c")
+	got := rf.fieldSpec.Resolve(len(tokens))
+	want := []int{2}
+	if len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("Resolve = %v, want %v", got, want)
+	}
+}
+
+func TestApplyFieldSpecInvalidNth(t *testing.T) {
+	rf := NewRegexpFilter()
+	if err := ApplyFieldSpec(rf, FilterConfig{Nth: "not-a-spec"}); err == nil {
+		t.Fatalf("expected an error for an invalid Nth spec")
+	}
+}
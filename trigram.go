@@ -0,0 +1,344 @@
+package peco
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sync"
+	"unicode"
+
+	"github.com/dav009/peco/queryexpr"
+)
+
+// TrigramThreshold is the number of lines a buffer must exceed before
+// RegexpFilter bothers building a trigram index for it. Up to this, the
+// cost of building the index outweighs whatever it saves.
+var TrigramThreshold = 50000
+
+// trigramKey packs 3 bytes into a single uint32 so a trigram can be
+// used directly as a map key without allocating a string.
+func trigramKey(a, b, c byte) uint32 {
+	return uint32(a)<<16 | uint32(b)<<8 | uint32(c)
+}
+
+func lowerASCII(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
+
+// TrigramPrefilter is a per-buffer inverted index from 3-byte trigrams
+// to the (zero-based, emission-order) IDs of the lines containing
+// them. RegexpFilter uses it to avoid running the real regexp against
+// lines that cannot possibly match.
+type TrigramPrefilter struct {
+	index map[uint32][]int
+	total int
+}
+
+// BuildTrigramPrefilter scans lines and builds the trigram index used
+// to prefilter regexp matching. Lines are indexed case-insensitively
+// so a single index can serve both case-sensitive and
+// case-insensitive queries.
+func BuildTrigramPrefilter(lines []string) *TrigramPrefilter {
+	tp := &TrigramPrefilter{
+		index: make(map[uint32][]int),
+		total: len(lines),
+	}
+
+	for id, l := range lines {
+		if len(l) < 3 {
+			continue
+		}
+
+		b := []byte(l)
+		var seen map[uint32]struct{}
+		for i := 0; i+2 < len(b); i++ {
+			k := trigramKey(lowerASCII(b[i]), lowerASCII(b[i+1]), lowerASCII(b[i+2]))
+			if seen == nil {
+				seen = make(map[uint32]struct{})
+			} else if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			tp.index[k] = append(tp.index[k], id)
+		}
+	}
+	return tp
+}
+
+func intersectIDs(a, b []int) []int {
+	out := make([]int, 0, min(len(a), len(b)))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func unionIDs(a, b []int) []int {
+	out := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	out = append(out, b[j:]...)
+	return out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// trigramExprOp enumerates the kinds of node in a trigramExpr tree.
+type trigramExprOp int
+
+const (
+	// trigramAny means no useful constraint could be derived; the
+	// prefilter must fall back to a full scan for this subexpression.
+	trigramAny trigramExprOp = iota
+	trigramLit
+	trigramAnd
+	trigramOr
+)
+
+// trigramExpr is a boolean expression over trigrams, derived from a
+// regexp's syntax tree, that a line must satisfy in order to have any
+// chance of matching the original regexp.
+type trigramExpr struct {
+	op       trigramExprOp
+	trigram  uint32
+	children []*trigramExpr
+}
+
+// candidates evaluates e against tp, returning the sorted, deduped
+// line IDs that could possibly match and ok == true if the expression
+// actually constrained the result. ok == false means "any line could
+// match this", i.e. fall back to a full scan.
+func (e *trigramExpr) candidates(tp *TrigramPrefilter) (ids []int, ok bool) {
+	switch e.op {
+	case trigramLit:
+		return tp.index[e.trigram], true
+	case trigramAnd:
+		for _, c := range e.children {
+			cids, cok := c.candidates(tp)
+			if !cok {
+				continue
+			}
+			if !ok {
+				ids, ok = cids, true
+				continue
+			}
+			ids = intersectIDs(ids, cids)
+		}
+		return ids, ok
+	case trigramOr:
+		for _, c := range e.children {
+			cids, cok := c.candidates(tp)
+			if !cok {
+				return nil, false
+			}
+			if !ok {
+				ids, ok = cids, true
+				continue
+			}
+			ids = unionIDs(ids, cids)
+		}
+		return ids, ok
+	default:
+		return nil, false
+	}
+}
+
+// literalTrigramExpr builds the AND of all trigrams found in a literal
+// run of runes. foldCase is set when the match is case-insensitive,
+// since trigram folding is only done for ASCII bytes (see lowerASCII);
+// a literal containing non-ASCII runes can't be safely indexed in
+// that case, so it degenerates to trigramAny.
+func literalTrigramExpr(runes []rune, foldCase bool) *trigramExpr {
+	if foldCase {
+		for _, r := range runes {
+			if r > unicode.MaxASCII {
+				return &trigramExpr{op: trigramAny}
+			}
+		}
+	}
+
+	s := string(runes)
+	if len(s) < 3 {
+		return &trigramExpr{op: trigramAny}
+	}
+
+	b := []byte(s)
+	and := &trigramExpr{op: trigramAnd}
+	seen := make(map[uint32]struct{})
+	for i := 0; i+2 < len(b); i++ {
+		k := trigramKey(lowerASCII(b[i]), lowerASCII(b[i+1]), lowerASCII(b[i+2]))
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		and.children = append(and.children, &trigramExpr{op: trigramLit, trigram: k})
+	}
+	return and
+}
+
+// deriveTrigramExpr walks a parsed regexp's syntax tree and derives a
+// trigramExpr describing which trigrams a matching line must contain.
+// Only OpLiteral, OpConcat, OpCapture and OpAlternate are understood;
+// anything else (character classes, ., repetition, anchors, ...)
+// contributes trigramAny for that part of the tree.
+func deriveTrigramExpr(re *syntax.Regexp) *trigramExpr {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalTrigramExpr(re.Rune, re.Flags&syntax.FoldCase != 0)
+	case syntax.OpCapture:
+		if len(re.Sub) == 1 {
+			return deriveTrigramExpr(re.Sub[0])
+		}
+		return &trigramExpr{op: trigramAny}
+	case syntax.OpConcat:
+		and := &trigramExpr{op: trigramAnd}
+		for _, sub := range re.Sub {
+			and.children = append(and.children, deriveTrigramExpr(sub))
+		}
+		return and
+	case syntax.OpAlternate:
+		or := &trigramExpr{op: trigramOr}
+		for _, sub := range re.Sub {
+			or.children = append(or.children, deriveTrigramExpr(sub))
+		}
+		return or
+	default:
+		return &trigramExpr{op: trigramAny}
+	}
+}
+
+// trigramExprForRegexp parses re's source text with the same syntax
+// flags regexp.Compile itself uses and derives a trigramExpr from it.
+// It returns trigramAny (ok == false when evaluated) if re's source
+// cannot be parsed, which should not normally happen since re itself
+// compiled successfully.
+func trigramExprForRegexp(re *regexp.Regexp) *trigramExpr {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return &trigramExpr{op: trigramAny}
+	}
+	return deriveTrigramExpr(parsed.Simplify())
+}
+
+// trigramExprForNode mirrors a queryexpr.Node tree into a trigramExpr,
+// so the prefilter can be reused for the boolean query grammar: And
+// and Or map directly, and a Not (which can only rule lines out, never
+// require a trigram to be present) contributes trigramAny.
+func trigramExprForNode(n queryexpr.Node) *trigramExpr {
+	switch n := n.(type) {
+	case *queryexpr.Term:
+		return trigramExprForRegexp(n.Re)
+	case *queryexpr.And:
+		return &trigramExpr{op: trigramAnd, children: []*trigramExpr{
+			trigramExprForNode(n.Left),
+			trigramExprForNode(n.Right),
+		}}
+	case *queryexpr.Or:
+		return &trigramExpr{op: trigramOr, children: []*trigramExpr{
+			trigramExprForNode(n.Left),
+			trigramExprForNode(n.Right),
+		}}
+	default:
+		return &trigramExpr{op: trigramAny}
+	}
+}
+
+// trigramSource is implemented by line buffers that can expose their
+// contents for indexing. *RawLineBuffer satisfies this.
+type trigramSource interface {
+	Pipeliner
+	Size() int
+	LineAt(int) (Line, error)
+}
+
+// trigramIndexCache remembers the TrigramPrefilter built for a given
+// buffer so that it's built at most once and reused across keystrokes,
+// even though a fresh *RegexpFilter is cloned for every query.
+type trigramIndexCache struct {
+	mu sync.Mutex
+	m  map[Pipeliner]*TrigramPrefilter
+}
+
+var trigramCache = &trigramIndexCache{m: make(map[Pipeliner]*TrigramPrefilter)}
+
+func (c *trigramIndexCache) get(src trigramSource) *TrigramPrefilter {
+	c.mu.Lock()
+	tp, ok := c.m[src]
+	c.mu.Unlock()
+	if ok {
+		return tp
+	}
+
+	lines := make([]string, src.Size())
+	for i := range lines {
+		l, err := src.LineAt(i)
+		if err != nil {
+			return nil
+		}
+		lines[i] = l.DisplayString()
+	}
+	tp = BuildTrigramPrefilter(lines)
+
+	c.mu.Lock()
+	c.m[src] = tp
+	c.mu.Unlock()
+	return tp
+}
+
+// filterByLineID reads Lines from in, in order, and forwards only
+// those whose zero-based position among the lines read so far appears
+// in ids (which must be sorted ascending). It's used to skip over
+// lines the trigram prefilter has already ruled out without touching
+// the real regexp at all.
+func filterByLineID(cancelCh chan struct{}, in chan Line, ids []int) chan Line {
+	out := make(chan Line)
+	go func() {
+		defer close(out)
+		i, pos := 0, 0
+		for l := range in {
+			for i < len(ids) && ids[i] < pos {
+				i++
+			}
+			if i < len(ids) && ids[i] == pos {
+				select {
+				case out <- l:
+				case <-cancelCh:
+					return
+				}
+			}
+			pos++
+		}
+	}()
+	return out
+}